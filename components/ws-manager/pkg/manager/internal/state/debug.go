@@ -0,0 +1,101 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// DebugObject is the minimal identity of one cached object. A DebugSnapshot
+// dumps this instead of the full Kubernetes object so it stays readable.
+type DebugObject struct {
+	Namespace string            `json:"namespace" yaml:"namespace"`
+	Name      string            `json:"name" yaml:"name"`
+	Labels    map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+}
+
+// DebugSnapshot is a point-in-time dump of a Storer's caches, so on-call
+// engineers can inspect its state without attaching a debugger.
+type DebugSnapshot struct {
+	ConfigMaps []DebugObject `json:"configMaps,omitempty" yaml:"configMaps,omitempty"`
+	Secrets    []DebugObject `json:"secrets,omitempty" yaml:"secrets,omitempty"`
+	Services   []DebugObject `json:"services,omitempty" yaml:"services,omitempty"`
+	Pods       []DebugObject `json:"pods,omitempty" yaml:"pods,omitempty"`
+
+	ResourceVersions map[string]string `json:"resourceVersions,omitempty" yaml:"resourceVersions,omitempty"`
+}
+
+// Debug snapshots s's ConfigMap/Secret/Service/Pod caches and their known
+// ResourceVersions. If filter is a non-empty "key=value" pair, only objects
+// carrying that label are included.
+func Debug(s Storer, filter string) (*DebugSnapshot, error) {
+	match, err := labelFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	snap := &DebugSnapshot{
+		ResourceVersions: map[string]string{
+			"configmaps": s.ResourceVersion(schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}),
+			"secrets":    s.ResourceVersion(schema.GroupVersionResource{Version: "v1", Resource: "secrets"}),
+			"services":   s.ResourceVersion(schema.GroupVersionResource{Version: "v1", Resource: "services"}),
+			"pods":       s.ResourceVersion(schema.GroupVersionResource{Version: "v1", Resource: "pods"}),
+		},
+	}
+
+	for _, cm := range s.ConfigMaps() {
+		if match(cm.Labels) {
+			snap.ConfigMaps = append(snap.ConfigMaps, DebugObject{Namespace: cm.Namespace, Name: cm.Name, Labels: cm.Labels})
+		}
+	}
+	for _, sec := range s.Secrets() {
+		if match(sec.Labels) {
+			snap.Secrets = append(snap.Secrets, DebugObject{Namespace: sec.Namespace, Name: sec.Name, Labels: sec.Labels})
+		}
+	}
+	for _, svc := range s.Services() {
+		if match(svc.Labels) {
+			snap.Services = append(snap.Services, DebugObject{Namespace: svc.Namespace, Name: svc.Name, Labels: svc.Labels})
+		}
+	}
+	for _, pod := range s.Pods() {
+		if match(pod.Labels) {
+			snap.Pods = append(snap.Pods, DebugObject{Namespace: pod.Namespace, Name: pod.Name, Labels: pod.Labels})
+		}
+	}
+
+	return snap, nil
+}
+
+// WriteDebug writes snap to w as either "json" (the default) or "yaml".
+func WriteDebug(w io.Writer, snap *DebugSnapshot, output string) error {
+	switch output {
+	case "", "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(snap)
+	case "yaml":
+		return yaml.NewEncoder(w).Encode(snap)
+	default:
+		return fmt.Errorf("unknown output format %q, want json or yaml", output)
+	}
+}
+
+func labelFilter(filter string) (func(map[string]string) bool, error) {
+	if filter == "" {
+		return func(map[string]string) bool { return true }, nil
+	}
+
+	key, value, ok := strings.Cut(filter, "=")
+	if !ok {
+		return nil, fmt.Errorf("invalid filter %q, want key=value", filter)
+	}
+
+	return func(labels map[string]string) bool {
+		return labels[key] == value
+	}, nil
+}
@@ -0,0 +1,193 @@
+package state
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/gitpod-io/gitpod/common-go/log"
+)
+
+// EventType describes the kind of change an informer observed for a
+// subscribed object.
+type EventType int
+
+const (
+	// EventAdd is emitted when an object is first observed.
+	EventAdd EventType = iota
+	// EventUpdate is emitted when an object changed.
+	EventUpdate
+	// EventDelete is emitted when an object was removed.
+	EventDelete
+	// EventResync is emitted when the informer's periodic resync re-delivers
+	// an object whose ResourceVersion hasn't actually changed.
+	EventResync
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventAdd:
+		return "Add"
+	case EventUpdate:
+		return "Update"
+	case EventDelete:
+		return "Delete"
+	case EventResync:
+		return "Resync"
+	default:
+		return "Unknown"
+	}
+}
+
+// CancelFunc stops a subscription previously returned by one of the
+// Subscribe* methods. It's safe to call more than once.
+type CancelFunc func()
+
+// subscriberChanBuffer bounds how many events a subscriber can lag behind
+// before further events are dropped rather than blocking informer delivery
+// for everyone else.
+const subscriberChanBuffer = 64
+
+type rawEvent struct {
+	eventType EventType
+	old, new  interface{}
+}
+
+// subscriber fans out raw informer events to a single caller, after applying
+// that caller's label/field selector.
+type subscriber struct {
+	id       uint64
+	sel      labels.Selector
+	fieldSel fields.Selector
+	events   chan rawEvent
+	done     chan struct{}
+	dropped  uint64
+}
+
+func newSubscriber(id uint64, sel labels.Selector, fieldSel fields.Selector) *subscriber {
+	return &subscriber{
+		id:       id,
+		sel:      sel,
+		fieldSel: fieldSel,
+		events:   make(chan rawEvent, subscriberChanBuffer),
+		done:     make(chan struct{}),
+	}
+}
+
+func (s *subscriber) matches(obj interface{}) bool {
+	if obj == nil {
+		return true
+	}
+
+	m, err := meta.Accessor(obj)
+	if err != nil {
+		return false
+	}
+
+	if s.sel != nil && !s.sel.Empty() && !s.sel.Matches(labels.Set(m.GetLabels())) {
+		return false
+	}
+
+	if s.fieldSel != nil && !s.fieldSel.Empty() {
+		fs := fields.Set{"metadata.name": m.GetName(), "metadata.namespace": m.GetNamespace()}
+		if !s.fieldSel.Matches(fs) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// publish delivers evt to the subscriber if it matches the selector,
+// dropping it and counting the drop if the subscriber's buffer is full.
+func (s *subscriber) publish(evt rawEvent) {
+	obj := evt.new
+	if obj == nil {
+		obj = evt.old
+	}
+	if !s.matches(obj) {
+		return
+	}
+
+	select {
+	case s.events <- evt:
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+		log.WithField("subscriberID", s.id).WithField("dropped", atomic.LoadUint64(&s.dropped)).Warn("subscriber channel full, dropping event")
+	}
+}
+
+// dispatcher fans out a single informer's ResourceEventHandler callbacks to
+// any number of filtered subscribers.
+type dispatcher struct {
+	mu          sync.RWMutex
+	nextID      uint64
+	subscribers map[uint64]*subscriber
+}
+
+func newDispatcher() *dispatcher {
+	return &dispatcher{subscribers: make(map[uint64]*subscriber)}
+}
+
+func (d *dispatcher) subscribe(sel labels.Selector, fieldSel fields.Selector) *subscriber {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.nextID++
+	sub := newSubscriber(d.nextID, sel, fieldSel)
+	d.subscribers[sub.id] = sub
+	return sub
+}
+
+func (d *dispatcher) cancel(id uint64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	sub, ok := d.subscribers[id]
+	if !ok {
+		return
+	}
+	delete(d.subscribers, id)
+	close(sub.done)
+}
+
+func (d *dispatcher) publish(evt rawEvent) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	for _, sub := range d.subscribers {
+		sub.publish(evt)
+	}
+}
+
+// resourceEventHandler builds a cache.ResourceEventHandlerFuncs that forwards
+// every Add/Update/Delete callback to d, classifying no-op updates (the
+// ResourceVersion didn't change) as EventResync rather than EventUpdate.
+func resourceEventHandler(d *dispatcher) cache.ResourceEventHandlerFuncs {
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			d.publish(rawEvent{eventType: EventAdd, new: obj})
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			eventType := EventUpdate
+
+			oldMeta, oerr := meta.Accessor(oldObj)
+			newMeta, nerr := meta.Accessor(newObj)
+			if oerr == nil && nerr == nil && oldMeta.GetResourceVersion() == newMeta.GetResourceVersion() {
+				eventType = EventResync
+			}
+
+			d.publish(rawEvent{eventType: eventType, old: oldObj, new: newObj})
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			d.publish(rawEvent{eventType: EventDelete, old: obj})
+		},
+	}
+}
@@ -0,0 +1,134 @@
+package state
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+func TestSubscriberMatches(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "foo",
+			Namespace: "ws",
+			Labels:    map[string]string{"component": "workspace"},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		sel      labels.Selector
+		fieldSel fields.Selector
+		want     bool
+	}{
+		{"nil selectors match", nil, nil, true},
+		{"matching label selector", labels.SelectorFromSet(labels.Set{"component": "workspace"}), nil, true},
+		{"non-matching label selector", labels.SelectorFromSet(labels.Set{"component": "other"}), nil, false},
+		{"matching field selector", nil, fields.OneTermEqualSelector("metadata.name", "foo"), true},
+		{"non-matching field selector", nil, fields.OneTermEqualSelector("metadata.name", "bar"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sub := newSubscriber(1, tt.sel, tt.fieldSel)
+			if got := sub.matches(pod); got != tt.want {
+				t.Errorf("matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSubscriberMatchesNilObjectAlwaysMatches(t *testing.T) {
+	sub := newSubscriber(1, labels.SelectorFromSet(labels.Set{"component": "workspace"}), nil)
+	if !sub.matches(nil) {
+		t.Error("matches(nil) = false, want true")
+	}
+}
+
+func TestDispatcherPublishFiltersBySelector(t *testing.T) {
+	d := newDispatcher()
+
+	matching := d.subscribe(labels.SelectorFromSet(labels.Set{"component": "workspace"}), nil)
+	other := d.subscribe(labels.SelectorFromSet(labels.Set{"component": "other"}), nil)
+
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"component": "workspace"}}}
+	d.publish(rawEvent{eventType: EventAdd, new: pod})
+
+	select {
+	case evt := <-matching.events:
+		if evt.eventType != EventAdd {
+			t.Errorf("eventType = %v, want EventAdd", evt.eventType)
+		}
+	default:
+		t.Error("expected the matching subscriber to receive the event")
+	}
+
+	select {
+	case evt := <-other.events:
+		t.Errorf("non-matching subscriber received event %v, want none", evt)
+	default:
+	}
+}
+
+func TestDispatcherCancelStopsDelivery(t *testing.T) {
+	d := newDispatcher()
+	sub := d.subscribe(nil, nil)
+	cancelID := sub.id
+
+	d.cancel(cancelID)
+
+	select {
+	case <-sub.done:
+	default:
+		t.Error("expected sub.done to be closed after cancel")
+	}
+
+	d.publish(rawEvent{eventType: EventAdd, new: &corev1.Pod{}})
+	select {
+	case evt := <-sub.events:
+		t.Errorf("cancelled subscriber received event %v, want none", evt)
+	default:
+	}
+}
+
+func TestSubscriberPublishDropsWhenBufferFull(t *testing.T) {
+	sub := newSubscriber(1, nil, nil)
+
+	for i := 0; i < subscriberChanBuffer; i++ {
+		sub.publish(rawEvent{eventType: EventAdd})
+	}
+
+	sub.publish(rawEvent{eventType: EventAdd})
+
+	if sub.dropped != 1 {
+		t.Errorf("dropped = %d, want 1", sub.dropped)
+	}
+	if len(sub.events) != subscriberChanBuffer {
+		t.Errorf("len(events) = %d, want %d", len(sub.events), subscriberChanBuffer)
+	}
+}
+
+func TestResourceEventHandlerClassifiesResync(t *testing.T) {
+	d := newDispatcher()
+	sub := d.subscribe(nil, nil)
+	handler := resourceEventHandler(d)
+
+	oldPod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "foo", ResourceVersion: "1"}}
+	sameRVPod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "foo", ResourceVersion: "1"}}
+	newRVPod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "foo", ResourceVersion: "2"}}
+
+	handler.UpdateFunc(oldPod, sameRVPod)
+	evt := <-sub.events
+	if evt.eventType != EventResync {
+		t.Errorf("eventType for an unchanged ResourceVersion = %v, want EventResync", evt.eventType)
+	}
+
+	handler.UpdateFunc(oldPod, newRVPod)
+	evt = <-sub.events
+	if evt.eventType != EventUpdate {
+		t.Errorf("eventType for a changed ResourceVersion = %v, want EventUpdate", evt.eventType)
+	}
+}
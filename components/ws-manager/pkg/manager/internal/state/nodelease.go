@@ -0,0 +1,53 @@
+package state
+
+import (
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+)
+
+// kubeNodeLeaseNamespace is where the kubelet renews its per-node Lease,
+// following the NodeLease feature (KEP-0009).
+const kubeNodeLeaseNamespace = "kube-node-lease"
+
+// DefaultNodeLeaseDurationSeconds mirrors the kubelet's default
+// --node-lease-duration-seconds, used when NewStateHolder is given a
+// nodeLeaseDurationSeconds <= 0.
+const DefaultNodeLeaseDurationSeconds = 40
+
+// NodeLiveness reports when nodeName's kubelet last renewed its Lease in
+// kube-node-lease, and whether that renewal is stale. A missing Lease, or
+// one without a RenewTime, is reported as stale with a zero renewedAt.
+func (sh stateHolder) NodeLiveness(nodeName string) (renewedAt time.Time, stale bool) {
+	item, exists, err := sh.leaseInformer.GetStore().GetByKey(kubeNodeLeaseNamespace + "/" + nodeName)
+	if err != nil || !exists {
+		return time.Time{}, true
+	}
+
+	lease, ok := item.(*coordinationv1.Lease)
+	if !ok || lease.Spec.RenewTime == nil {
+		return time.Time{}, true
+	}
+
+	renewedAt = lease.Spec.RenewTime.Time
+	maxAge := 2 * time.Duration(sh.nodeLeaseDurationSeconds) * time.Second
+	stale = time.Since(renewedAt) > maxAge
+
+	return renewedAt, stale
+}
+
+// PodListOption customizes the pods returned by PodsWithListOptions.
+type PodListOption func(*podListConfig)
+
+type podListConfig struct {
+	excludeStaleNodeLeasePods bool
+}
+
+// WithoutStaleNodeLeasePods excludes pods scheduled onto a node whose
+// kube-node-lease Lease hasn't been renewed recently, so callers like
+// ws-manager and registry-facade stop routing workspaces to a node the
+// kubelet has silently dropped off, without waiting for the standard
+// pod-eviction timeout.
+func WithoutStaleNodeLeasePods() PodListOption {
+	return func(c *podListConfig) { c.excludeStaleNodeLeasePods = true }
+}
@@ -0,0 +1,143 @@
+package state
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	"github.com/gitpod-io/gitpod/common-go/log"
+)
+
+// resourceVersionFlushInterval bounds how often persisted ResourceVersions
+// are written to disk, so a busy namespace's Add/Update/Delete callbacks
+// never block on file I/O.
+const resourceVersionFlushInterval = 5 * time.Second
+
+// resourceVersionEntry is the on-disk representation of one tracked
+// GroupVersionResource, since schema.GroupVersionResource isn't a valid JSON
+// object key.
+type resourceVersionEntry struct {
+	GVR             schema.GroupVersionResource `json:"gvr"`
+	ResourceVersion string                      `json:"resourceVersion"`
+}
+
+// resourceVersionTracker remembers the most recently observed
+// ResourceVersion per GroupVersionResource, optionally persisting it to disk
+// so a restarted process can ask the API server for a not-older-than list
+// off its watch cache instead of a full quorum relist.
+//
+// Persistence is debounced: Set only marks the tracker dirty, and a single
+// background goroutine flushes it to disk on resourceVersionFlushInterval,
+// so informer event delivery never blocks on disk I/O and concurrent Sets
+// can't race two overlapping writes.
+type resourceVersionTracker struct {
+	mu       sync.RWMutex
+	versions map[schema.GroupVersionResource]string
+
+	statePath string
+	dirty     atomic.Bool
+}
+
+func newResourceVersionTracker(statePath string) *resourceVersionTracker {
+	t := &resourceVersionTracker{
+		versions:  make(map[schema.GroupVersionResource]string),
+		statePath: statePath,
+	}
+
+	if statePath == "" {
+		return t
+	}
+
+	entries, err := loadResourceVersions(statePath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.WithError(err).WithField("path", statePath).Warn("could not load persisted resource versions, falling back to a full relist")
+		}
+	} else {
+		for _, e := range entries {
+			t.versions[e.GVR] = e.ResourceVersion
+		}
+	}
+
+	go t.persistLoop()
+
+	return t
+}
+
+func (t *resourceVersionTracker) Get(gvr schema.GroupVersionResource) string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.versions[gvr]
+}
+
+func (t *resourceVersionTracker) Set(gvr schema.GroupVersionResource, rv string) {
+	if rv == "" {
+		return
+	}
+
+	t.mu.Lock()
+	t.versions[gvr] = rv
+	t.mu.Unlock()
+
+	if t.statePath != "" {
+		t.dirty.Store(true)
+	}
+}
+
+// persistLoop flushes the tracker to disk at most once every
+// resourceVersionFlushInterval, and only when something actually changed
+// since the last flush.
+func (t *resourceVersionTracker) persistLoop() {
+	ticker := time.NewTicker(resourceVersionFlushInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if !t.dirty.CompareAndSwap(true, false) {
+			continue
+		}
+
+		if err := t.flush(); err != nil {
+			log.WithError(err).WithField("path", t.statePath).Warn("could not persist resource versions")
+			t.dirty.Store(true)
+		}
+	}
+}
+
+func (t *resourceVersionTracker) flush() error {
+	t.mu.RLock()
+	entries := make([]resourceVersionEntry, 0, len(t.versions))
+	for g, v := range t.versions {
+		entries = append(entries, resourceVersionEntry{GVR: g, ResourceVersion: v})
+	}
+	t.mu.RUnlock()
+
+	return saveResourceVersions(t.statePath, entries)
+}
+
+func loadResourceVersions(path string) ([]resourceVersionEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []resourceVersionEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+func saveResourceVersions(path string, entries []resourceVersionEntry) error {
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, data, 0o644)
+}
@@ -0,0 +1,45 @@
+package state
+
+import (
+	"path/filepath"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestResourceVersionTrackerGetSet(t *testing.T) {
+	tr := newResourceVersionTracker("")
+
+	gvr := schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+	if got := tr.Get(gvr); got != "" {
+		t.Fatalf("Get() on an empty tracker = %q, want \"\"", got)
+	}
+
+	tr.Set(gvr, "42")
+	if got := tr.Get(gvr); got != "42" {
+		t.Fatalf("Get() after Set = %q, want \"42\"", got)
+	}
+
+	// An empty ResourceVersion is never a valid update and must be ignored.
+	tr.Set(gvr, "")
+	if got := tr.Get(gvr); got != "42" {
+		t.Fatalf("Get() after Set(\"\") = %q, want \"42\"", got)
+	}
+}
+
+func TestResourceVersionTrackerFlushAndReload(t *testing.T) {
+	statePath := filepath.Join(t.TempDir(), "resource-versions.json")
+
+	tr := newResourceVersionTracker(statePath)
+	gvr := schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}
+	tr.Set(gvr, "7")
+
+	if err := tr.flush(); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+
+	reloaded := newResourceVersionTracker(statePath)
+	if got := reloaded.Get(gvr); got != "7" {
+		t.Fatalf("Get() after reload = %q, want \"7\"", got)
+	}
+}
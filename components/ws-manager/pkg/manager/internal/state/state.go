@@ -1,19 +1,29 @@
 package state
 
 import (
+	"context"
 	"fmt"
 	"strings"
 	"time"
 
+	coordinationv1 "k8s.io/api/coordination/v1"
 	corev1 "k8s.io/api/core/v1"
 	apimeta "k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/labels"
-	"k8s.io/client-go/informers"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/pager"
 )
 
+// defaultListPageSize is used for the initial list of each informer when
+// NewStateHolder is called with a pageSize <= 0.
+const defaultListPageSize = 500
+
 // Storer ---
 type Storer interface {
 	ConfigMaps() []*corev1.ConfigMap
@@ -25,12 +35,43 @@ type Storer interface {
 	ServicesWithListOptions(metav1.ListOptions) ([]*corev1.Service, error)
 
 	Pods() []*corev1.Pod
-	PodsWithListOptions(metav1.ListOptions) ([]*corev1.Pod, error)
+	PodsWithListOptions(metav1.ListOptions, ...PodListOption) ([]*corev1.Pod, error)
 
 	GetConfigMap(key string) (*corev1.ConfigMap, error)
 	GetSecret(key string) (*corev1.Secret, error)
 	GetService(key string) (*corev1.Service, error)
 
+	// SubscribePods registers handler to be called for every Pod event that
+	// matches sel and fieldSel. Passing a nil selector matches everything.
+	// The returned CancelFunc stops delivery and releases the subscription.
+	SubscribePods(sel labels.Selector, fieldSel fields.Selector, handler func(EventType, *corev1.Pod, *corev1.Pod)) (CancelFunc, error)
+	// SubscribeConfigMaps registers handler to be called for every ConfigMap
+	// event that matches sel and fieldSel. Passing a nil selector matches
+	// everything. The returned CancelFunc stops delivery and releases the
+	// subscription.
+	SubscribeConfigMaps(sel labels.Selector, fieldSel fields.Selector, handler func(EventType, *corev1.ConfigMap, *corev1.ConfigMap)) (CancelFunc, error)
+	// SubscribeSecrets registers handler to be called for every Secret event
+	// that matches sel and fieldSel. Passing a nil selector matches
+	// everything. The returned CancelFunc stops delivery and releases the
+	// subscription.
+	SubscribeSecrets(sel labels.Selector, fieldSel fields.Selector, handler func(EventType, *corev1.Secret, *corev1.Secret)) (CancelFunc, error)
+	// SubscribeServices registers handler to be called for every Service
+	// event that matches sel and fieldSel. Passing a nil selector matches
+	// everything. The returned CancelFunc stops delivery and releases the
+	// subscription.
+	SubscribeServices(sel labels.Selector, fieldSel fields.Selector, handler func(EventType, *corev1.Service, *corev1.Service)) (CancelFunc, error)
+
+	// ResourceVersion returns the most recently observed ResourceVersion for
+	// gvr, or the empty string if nothing has been observed yet. Callers can
+	// use this to detect how stale their view of the cluster might be.
+	ResourceVersion(gvr schema.GroupVersionResource) string
+
+	// NodeLiveness reports when nodeName's kubelet last renewed its Lease in
+	// kube-node-lease, and whether that renewal is stale - i.e. older than
+	// twice the configured node lease duration. A node with no observed
+	// Lease at all is reported as stale with a zero renewedAt.
+	NodeLiveness(nodeName string) (renewedAt time.Time, stale bool)
+
 	Run(stopCh <-chan struct{})
 }
 
@@ -39,50 +80,213 @@ type stateHolder struct {
 
 	informers *sharedInformers
 	listers   *listers
+
+	configMapDispatcher *dispatcher
+	secretDispatcher    *dispatcher
+	serviceDispatcher   *dispatcher
+	podDispatcher       *dispatcher
+
+	resourceVersions *resourceVersionTracker
+
+	leaseInformer            cache.SharedIndexInformer
+	nodeLeaseDurationSeconds int64
 }
 
-func NewStateHolder(namespace string, listOptions metav1.ListOptions, resyncPeriod time.Duration, clientset kubernetes.Interface) Storer {
+// NewStateHolder sets up the Pod/ConfigMap/Secret/Service informers for
+// namespace. pageSize controls how many items each informer's initial list
+// fetches per request via a pager.ListPager (<=0 uses defaultListPageSize),
+// keeping memory bounded for large installations instead of pulling the
+// entire resource set into memory in one response.
+//
+// If resourceVersionStatePath is non-empty, the ResourceVersions observed
+// across the informers' lifetime are persisted there, and reloaded on the
+// next call so the initial list can ask the API server for a
+// not-older-than read off its watch cache rather than a full quorum relist.
+//
+// nodeLeaseDurationSeconds is the kubelet's configured
+// --node-lease-duration-seconds (<=0 uses DefaultNodeLeaseDurationSeconds);
+// it governs how old a kube-node-lease Lease may get before NodeLiveness
+// reports it as stale.
+func NewStateHolder(namespace string, listOptions metav1.ListOptions, resyncPeriod time.Duration, clientset kubernetes.Interface, pageSize int64, resourceVersionStatePath string, nodeLeaseDurationSeconds int64) Storer {
+	if pageSize <= 0 {
+		pageSize = defaultListPageSize
+	}
+	if nodeLeaseDurationSeconds <= 0 {
+		nodeLeaseDurationSeconds = DefaultNodeLeaseDurationSeconds
+	}
+
 	store := &stateHolder{
 		namespace: namespace,
 		informers: &sharedInformers{},
 		listers:   &listers{},
+
+		configMapDispatcher: newDispatcher(),
+		secretDispatcher:    newDispatcher(),
+		serviceDispatcher:   newDispatcher(),
+		podDispatcher:       newDispatcher(),
+
+		resourceVersions: newResourceVersionTracker(resourceVersionStatePath),
+
+		nodeLeaseDurationSeconds: nodeLeaseDurationSeconds,
 	}
 
-	informerFactory := informers.NewSharedInformerFactoryWithOptions(clientset, resyncPeriod,
-		informers.WithNamespace(namespace),
-		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
-			options.LabelSelector = listOptions.LabelSelector
-			options.FieldSelector = listOptions.FieldSelector
-		}),
-	)
+	tweakListOptions := func(options *metav1.ListOptions) {
+		options.LabelSelector = listOptions.LabelSelector
+		options.FieldSelector = listOptions.FieldSelector
+	}
 
-	store.informers.ConfigMap = informerFactory.Core().V1().ConfigMaps().Informer()
+	configMapGVR := corev1.SchemeGroupVersion.WithResource("configmaps")
+	store.informers.ConfigMap = cache.NewSharedIndexInformer(
+		store.pagedListWatch(configMapGVR, pageSize, tweakListOptions,
+			func(ctx context.Context, opts metav1.ListOptions) (runtime.Object, error) {
+				return clientset.CoreV1().ConfigMaps(namespace).List(ctx, opts)
+			},
+			func(ctx context.Context, opts metav1.ListOptions) (watch.Interface, error) {
+				return clientset.CoreV1().ConfigMaps(namespace).Watch(ctx, opts)
+			},
+		),
+		&corev1.ConfigMap{}, resyncPeriod, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc},
+	)
 	store.listers.ConfigMap.Store = store.informers.ConfigMap.GetStore()
 
-	store.informers.Secret = informerFactory.Core().V1().Secrets().Informer()
+	secretGVR := corev1.SchemeGroupVersion.WithResource("secrets")
+	store.informers.Secret = cache.NewSharedIndexInformer(
+		store.pagedListWatch(secretGVR, pageSize, tweakListOptions,
+			func(ctx context.Context, opts metav1.ListOptions) (runtime.Object, error) {
+				return clientset.CoreV1().Secrets(namespace).List(ctx, opts)
+			},
+			func(ctx context.Context, opts metav1.ListOptions) (watch.Interface, error) {
+				return clientset.CoreV1().Secrets(namespace).Watch(ctx, opts)
+			},
+		),
+		&corev1.Secret{}, resyncPeriod, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc},
+	)
 	store.listers.Secret.Store = store.informers.Secret.GetStore()
 
-	store.informers.Service = informerFactory.Core().V1().Services().Informer()
+	serviceGVR := corev1.SchemeGroupVersion.WithResource("services")
+	store.informers.Service = cache.NewSharedIndexInformer(
+		store.pagedListWatch(serviceGVR, pageSize, tweakListOptions,
+			func(ctx context.Context, opts metav1.ListOptions) (runtime.Object, error) {
+				return clientset.CoreV1().Services(namespace).List(ctx, opts)
+			},
+			func(ctx context.Context, opts metav1.ListOptions) (watch.Interface, error) {
+				return clientset.CoreV1().Services(namespace).Watch(ctx, opts)
+			},
+		),
+		&corev1.Service{}, resyncPeriod, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc},
+	)
 	store.listers.Service.Store = store.informers.Service.GetStore()
 
-	store.informers.Pod = informerFactory.Core().V1().Pods().Informer()
+	podGVR := corev1.SchemeGroupVersion.WithResource("pods")
+	store.informers.Pod = cache.NewSharedIndexInformer(
+		store.pagedListWatch(podGVR, pageSize, tweakListOptions,
+			func(ctx context.Context, opts metav1.ListOptions) (runtime.Object, error) {
+				return clientset.CoreV1().Pods(namespace).List(ctx, opts)
+			},
+			func(ctx context.Context, opts metav1.ListOptions) (watch.Interface, error) {
+				return clientset.CoreV1().Pods(namespace).Watch(ctx, opts)
+			},
+		),
+		&corev1.Pod{}, resyncPeriod, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc},
+	)
 	store.listers.Pod.Store = store.informers.Pod.GetStore()
 
-	eventHandlers := cache.ResourceEventHandlerFuncs{
+	store.informers.ConfigMap.AddEventHandler(store.trackResourceVersion(configMapGVR, resourceEventHandler(store.configMapDispatcher)))
+	store.informers.Secret.AddEventHandler(store.trackResourceVersion(secretGVR, resourceEventHandler(store.secretDispatcher)))
+	store.informers.Service.AddEventHandler(store.trackResourceVersion(serviceGVR, resourceEventHandler(store.serviceDispatcher)))
+	store.informers.Pod.AddEventHandler(store.trackResourceVersion(podGVR, resourceEventHandler(store.podDispatcher)))
+
+	leaseGVR := coordinationv1.SchemeGroupVersion.WithResource("leases")
+	store.leaseInformer = cache.NewSharedIndexInformer(
+		store.pagedListWatch(leaseGVR, pageSize, func(*metav1.ListOptions) {},
+			func(ctx context.Context, opts metav1.ListOptions) (runtime.Object, error) {
+				return clientset.CoordinationV1().Leases(kubeNodeLeaseNamespace).List(ctx, opts)
+			},
+			func(ctx context.Context, opts metav1.ListOptions) (watch.Interface, error) {
+				return clientset.CoordinationV1().Leases(kubeNodeLeaseNamespace).Watch(ctx, opts)
+			},
+		),
+		&coordinationv1.Lease{}, resyncPeriod, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc},
+	)
+
+	return store
+}
+
+// pagedListWatch builds a cache.ListWatch whose initial list is fetched page
+// by page via a pager.ListPager instead of in one unbounded request, and
+// whose list additionally asks for a not-older-than read off gvr's last
+// known ResourceVersion when a warm restart has one on hand - letting the
+// API server serve it from its watch cache instead of a full quorum relist.
+func (sh *stateHolder) pagedListWatch(
+	gvr schema.GroupVersionResource,
+	pageSize int64,
+	tweak func(*metav1.ListOptions),
+	list func(ctx context.Context, opts metav1.ListOptions) (runtime.Object, error),
+	watchFn func(ctx context.Context, opts metav1.ListOptions) (watch.Interface, error),
+) *cache.ListWatch {
+	return &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			tweak(&options)
+			if rv := sh.resourceVersions.Get(gvr); rv != "" {
+				options.ResourceVersion = rv
+				options.ResourceVersionMatch = metav1.ResourceVersionMatchNotOlderThan
+			}
+
+			p := pager.New(func(ctx context.Context, opts metav1.ListOptions) (runtime.Object, error) {
+				return list(ctx, opts)
+			})
+			p.PageSize = pageSize
+
+			obj, _, err := p.List(context.Background(), options)
+			if err != nil {
+				return nil, err
+			}
+
+			if rv, err := apimeta.NewAccessor().ResourceVersion(obj); err == nil && rv != "" {
+				sh.resourceVersions.Set(gvr, rv)
+			}
+
+			return obj, nil
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			tweak(&options)
+			options.Watch = true
+			return watchFn(context.Background(), options)
+		},
+	}
+}
+
+// trackResourceVersion wraps handler so every Add/Update/Delete callback
+// also records the object's ResourceVersion for gvr, persisting it if the
+// tracker was configured with a state path.
+func (sh *stateHolder) trackResourceVersion(gvr schema.GroupVersionResource, handler cache.ResourceEventHandler) cache.ResourceEventHandlerFuncs {
+	observe := func(obj interface{}) {
+		if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+			obj = tombstone.Obj
+		}
+		if m, err := apimeta.Accessor(obj); err == nil {
+			sh.resourceVersions.Set(gvr, m.GetResourceVersion())
+		}
+	}
+
+	return cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
+			observe(obj)
+			handler.OnAdd(obj)
 		},
 		UpdateFunc: func(oldObj, newObj interface{}) {
+			observe(newObj)
+			handler.OnUpdate(oldObj, newObj)
 		},
 		DeleteFunc: func(obj interface{}) {
+			observe(obj)
+			handler.OnDelete(obj)
 		},
 	}
+}
 
-	store.informers.ConfigMap.AddEventHandler(eventHandlers)
-	store.informers.Secret.AddEventHandler(eventHandlers)
-	store.informers.Service.AddEventHandler(eventHandlers)
-	store.informers.Pod.AddEventHandler(eventHandlers)
-
-	return store
+func (sh stateHolder) ResourceVersion(gvr schema.GroupVersionResource) string {
+	return sh.resourceVersions.Get(gvr)
 }
 
 func (sh stateHolder) ConfigMaps() []*corev1.ConfigMap {
@@ -175,7 +379,12 @@ func (sh stateHolder) Pods() []*corev1.Pod {
 	return pods
 }
 
-func (sh stateHolder) PodsWithListOptions(listOptions metav1.ListOptions) ([]*corev1.Pod, error) {
+func (sh stateHolder) PodsWithListOptions(listOptions metav1.ListOptions, opts ...PodListOption) ([]*corev1.Pod, error) {
+	var cfg podListConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
 	selector, _ := labels.Parse(listOptions.LabelSelector)
 	filteredObjs, err := filterWithLabels(sh.listers.Pod.List(), selector)
 	if err != nil {
@@ -184,18 +393,100 @@ func (sh stateHolder) PodsWithListOptions(listOptions metav1.ListOptions) ([]*co
 
 	var pods []*corev1.Pod
 	for _, item := range filteredObjs {
-		if pod, ok := item.(*corev1.Pod); ok {
-			pods = append(pods, pod)
+		pod, ok := item.(*corev1.Pod)
+		if !ok {
+			continue
+		}
+
+		if cfg.excludeStaleNodeLeasePods && pod.Spec.NodeName != "" {
+			if _, stale := sh.NodeLiveness(pod.Spec.NodeName); stale {
+				continue
+			}
 		}
+
+		pods = append(pods, pod)
 	}
 
 	return pods, nil
 }
 
 func (sh stateHolder) Run(stopCh <-chan struct{}) {
+	go sh.leaseInformer.Run(stopCh)
 	sh.informers.Run(stopCh)
 }
 
+func (sh stateHolder) SubscribePods(sel labels.Selector, fieldSel fields.Selector, handler func(EventType, *corev1.Pod, *corev1.Pod)) (CancelFunc, error) {
+	sub := sh.podDispatcher.subscribe(sel, fieldSel)
+	go func() {
+		for {
+			select {
+			case evt := <-sub.events:
+				old, _ := evt.old.(*corev1.Pod)
+				newObj, _ := evt.new.(*corev1.Pod)
+				handler(evt.eventType, old, newObj)
+			case <-sub.done:
+				return
+			}
+		}
+	}()
+
+	return func() { sh.podDispatcher.cancel(sub.id) }, nil
+}
+
+func (sh stateHolder) SubscribeConfigMaps(sel labels.Selector, fieldSel fields.Selector, handler func(EventType, *corev1.ConfigMap, *corev1.ConfigMap)) (CancelFunc, error) {
+	sub := sh.configMapDispatcher.subscribe(sel, fieldSel)
+	go func() {
+		for {
+			select {
+			case evt := <-sub.events:
+				old, _ := evt.old.(*corev1.ConfigMap)
+				newObj, _ := evt.new.(*corev1.ConfigMap)
+				handler(evt.eventType, old, newObj)
+			case <-sub.done:
+				return
+			}
+		}
+	}()
+
+	return func() { sh.configMapDispatcher.cancel(sub.id) }, nil
+}
+
+func (sh stateHolder) SubscribeSecrets(sel labels.Selector, fieldSel fields.Selector, handler func(EventType, *corev1.Secret, *corev1.Secret)) (CancelFunc, error) {
+	sub := sh.secretDispatcher.subscribe(sel, fieldSel)
+	go func() {
+		for {
+			select {
+			case evt := <-sub.events:
+				old, _ := evt.old.(*corev1.Secret)
+				newObj, _ := evt.new.(*corev1.Secret)
+				handler(evt.eventType, old, newObj)
+			case <-sub.done:
+				return
+			}
+		}
+	}()
+
+	return func() { sh.secretDispatcher.cancel(sub.id) }, nil
+}
+
+func (sh stateHolder) SubscribeServices(sel labels.Selector, fieldSel fields.Selector, handler func(EventType, *corev1.Service, *corev1.Service)) (CancelFunc, error) {
+	sub := sh.serviceDispatcher.subscribe(sel, fieldSel)
+	go func() {
+		for {
+			select {
+			case evt := <-sub.events:
+				old, _ := evt.old.(*corev1.Service)
+				newObj, _ := evt.new.(*corev1.Service)
+				handler(evt.eventType, old, newObj)
+			case <-sub.done:
+				return
+			}
+		}
+	}()
+
+	return func() { sh.serviceDispatcher.cancel(sub.id) }, nil
+}
+
 func getObjectKey(input, defNs string) string {
 	nsName := strings.Split(input, "/")
 	if len(nsName) == 0 {
@@ -0,0 +1,130 @@
+// Copyright (c) 2021 Gitpod GmbH. All rights reserved.
+// Licensed under the GNU Affero General Public License (AGPL).
+// See License-AGPL.txt in the project root for license information.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// boundedCache bounds an otherwise unbounded map with both an LRU size limit
+// and a max-age sweep, so a long-running exporter's memory stays proportional
+// to event churn rather than to how long the process has been running.
+type boundedCache struct {
+	mu     sync.Mutex
+	lru    *lru.Cache
+	maxAge time.Duration
+
+	size      prometheus.Gauge
+	evictions prometheus.Counter
+}
+
+type cacheEntry struct {
+	added time.Time
+	value interface{}
+}
+
+// newBoundedCache creates a cache holding at most maxEntries items, evicting
+// the least recently used entry once that limit is hit. If maxAge is
+// positive, prune additionally removes entries older than maxAge regardless
+// of size. size and evictions are updated in place so they can be registered
+// once and shared across the cache's lifetime. It returns an error if
+// maxEntries isn't positive.
+func newBoundedCache(maxEntries int, maxAge time.Duration, size prometheus.Gauge, evictions prometheus.Counter) (*boundedCache, error) {
+	l, err := lru.New(maxEntries)
+	if err != nil {
+		return nil, fmt.Errorf("creating cache: %w", err)
+	}
+
+	return &boundedCache{lru: l, maxAge: maxAge, size: size, evictions: evictions}, nil
+}
+
+// Add evicts the least recently used entry if the cache is at capacity. That
+// capacity-driven eviction counts toward evictions, as do prune's max-age
+// evictions - an explicit Remove, such as the one main.go issues on
+// SnapshotRemove, is a normal part of the event lifecycle and isn't counted.
+func (c *boundedCache) Add(key, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.lru.Add(key, &cacheEntry{added: time.Now(), value: value}) {
+		c.evictions.Inc()
+	}
+	c.size.Set(float64(c.lru.Len()))
+}
+
+func (c *boundedCache) Get(key interface{}) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	v, ok := c.lru.Get(key)
+	if !ok {
+		return nil, false
+	}
+	return v.(*cacheEntry).value, true
+}
+
+func (c *boundedCache) Remove(key interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.lru.Remove(key) {
+		c.size.Set(float64(c.lru.Len()))
+	}
+}
+
+// cacheDumpEntry is a snapshot of one cache entry, for debugging.
+type cacheDumpEntry struct {
+	Key   string
+	Added time.Time
+	Value interface{}
+}
+
+// Entries returns a snapshot of every entry currently in the cache. It's
+// meant for debugging/inspection and doesn't refresh LRU recency.
+func (c *boundedCache) Entries() []cacheDumpEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	keys := c.lru.Keys()
+	out := make([]cacheDumpEntry, 0, len(keys))
+	for _, k := range keys {
+		v, ok := c.lru.Peek(k)
+		if !ok {
+			continue
+		}
+		e := v.(*cacheEntry)
+		out = append(out, cacheDumpEntry{Key: fmt.Sprintf("%v", k), Added: e.added, Value: e.value})
+	}
+	return out
+}
+
+// prune evicts entries older than maxAge. It's a no-op when maxAge is <= 0.
+func (c *boundedCache) prune() {
+	if c.maxAge <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cutoff := time.Now().Add(-c.maxAge)
+	for _, key := range c.lru.Keys() {
+		v, ok := c.lru.Peek(key)
+		if !ok {
+			continue
+		}
+		if v.(*cacheEntry).added.Before(cutoff) {
+			if c.lru.Remove(key) {
+				c.evictions.Inc()
+			}
+		}
+	}
+	c.size.Set(float64(c.lru.Len()))
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2021 Gitpod GmbH. All rights reserved.
+// Licensed under the GNU Affero General Public License (AGPL).
+// See License-AGPL.txt in the project root for license information.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestNewBoundedCacheRejectsNonPositiveMaxEntries(t *testing.T) {
+	size := prometheus.NewGauge(prometheus.GaugeOpts{Name: "size"})
+	evictions := prometheus.NewCounter(prometheus.CounterOpts{Name: "evictions"})
+
+	if _, err := newBoundedCache(0, 0, size, evictions); err == nil {
+		t.Fatal("expected an error for max-entries 0, got nil")
+	}
+}
+
+func TestBoundedCacheAddCountsCapacityEvictionsOnly(t *testing.T) {
+	size := prometheus.NewGauge(prometheus.GaugeOpts{Name: "size"})
+	evictions := prometheus.NewCounter(prometheus.CounterOpts{Name: "evictions"})
+
+	c, err := newBoundedCache(2, 0, size, evictions)
+	if err != nil {
+		t.Fatalf("newBoundedCache: %v", err)
+	}
+
+	c.Add("a", 1)
+	c.Add("b", 2)
+	if got := testutil.ToFloat64(evictions); got != 0 {
+		t.Fatalf("evictions after filling capacity = %v, want 0", got)
+	}
+
+	c.Add("c", 3)
+	if got := testutil.ToFloat64(evictions); got != 1 {
+		t.Fatalf("evictions after one over-capacity add = %v, want 1", got)
+	}
+}
+
+func TestBoundedCacheRemoveDoesNotCountAsEviction(t *testing.T) {
+	size := prometheus.NewGauge(prometheus.GaugeOpts{Name: "size"})
+	evictions := prometheus.NewCounter(prometheus.CounterOpts{Name: "evictions"})
+
+	c, err := newBoundedCache(2, 0, size, evictions)
+	if err != nil {
+		t.Fatalf("newBoundedCache: %v", err)
+	}
+
+	c.Add("a", 1)
+	c.Remove("a")
+
+	if got := testutil.ToFloat64(evictions); got != 0 {
+		t.Fatalf("evictions after explicit Remove = %v, want 0", got)
+	}
+	if _, ok := c.Get("a"); ok {
+		t.Fatal("expected \"a\" to be gone after Remove")
+	}
+}
+
+func TestBoundedCachePruneCountsAgeEvictions(t *testing.T) {
+	size := prometheus.NewGauge(prometheus.GaugeOpts{Name: "size"})
+	evictions := prometheus.NewCounter(prometheus.CounterOpts{Name: "evictions"})
+
+	c, err := newBoundedCache(10, time.Millisecond, size, evictions)
+	if err != nil {
+		t.Fatalf("newBoundedCache: %v", err)
+	}
+
+	c.Add("a", 1)
+	time.Sleep(5 * time.Millisecond)
+	c.prune()
+
+	if got := testutil.ToFloat64(evictions); got != 1 {
+		t.Fatalf("evictions after prune of an aged-out entry = %v, want 1", got)
+	}
+	if _, ok := c.Get("a"); ok {
+		t.Fatal("expected \"a\" to be pruned")
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright (c) 2021 Gitpod GmbH. All rights reserved.
+// Licensed under the GNU Affero General Public License (AGPL).
+// See License-AGPL.txt in the project root for license information.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type debugPrepEntry struct {
+	Key    string    `json:"key"`
+	Parent string    `json:"parent"`
+	Added  time.Time `json:"added"`
+}
+
+type debugCommitEntry struct {
+	Key    string        `json:"key"`
+	Name   string        `json:"name"`
+	Parent string        `json:"parent"`
+	Dur    time.Duration `json:"dur"`
+	Added  time.Time     `json:"added"`
+}
+
+// debugImageChain is one image's reconstructed layer chain, in the same
+// parent-to-child order pushContainerMetrics builds for its Image.Layer.
+type debugImageChain struct {
+	Root   string  `json:"root"`
+	Layers []Layer `json:"layers"`
+}
+
+type debugState struct {
+	Prep   []debugPrepEntry   `json:"prep"`
+	Commit []debugCommitEntry `json:"commit"`
+	Images []debugImageChain  `json:"images"`
+}
+
+// buildDebugState snapshots prepByKey and commitByKey, and reconstructs each
+// image's layer chain by walking Commit.Parent through commitByName - rooted
+// at every commit that isn't itself referenced as some other commit's parent.
+// commitByName's entries are not dumped on their own; they only appear as
+// layers of those chains.
+func buildDebugState(filterKey, filterValue string) debugState {
+	var ds debugState
+
+	for _, e := range prepByKey.Entries() {
+		if !matchesFilter(filterKey, filterValue, "key", e.Key) {
+			continue
+		}
+		ds.Prep = append(ds.Prep, debugPrepEntry{Key: e.Key, Parent: e.Value.(*Prep).Parent, Added: e.Added})
+	}
+
+	commits := commitByName.Entries()
+
+	for _, e := range commitByKey.Entries() {
+		c := e.Value.(*Commit)
+		if !matchesFilter(filterKey, filterValue, "key", e.Key) && !matchesFilter(filterKey, filterValue, "name", c.Name) {
+			continue
+		}
+		ds.Commit = append(ds.Commit, debugCommitEntry{Key: e.Key, Name: c.Name, Parent: c.Parent, Dur: c.Dur, Added: e.Added})
+	}
+
+	parented := make(map[string]bool, len(commits))
+	for _, e := range commits {
+		if parent := e.Value.(*Commit).Parent; parent != "" {
+			parented[parent] = true
+		}
+	}
+
+	for _, e := range commits {
+		root := e.Value.(*Commit)
+		if parented[root.Name] {
+			continue
+		}
+		if !matchesFilter(filterKey, filterValue, "name", root.Name) {
+			continue
+		}
+
+		var layers []Layer
+		for c, ok := root, true; ok; {
+			layers = append(layers, Layer{ID: c.Name, Prep: c.Dur})
+
+			var v interface{}
+			v, ok = commitByName.Get(c.Parent)
+			if ok {
+				c = v.(*Commit)
+			}
+		}
+		for i, j := 0, len(layers)-1; i < j; i, j = i+1, j-1 {
+			layers[i], layers[j] = layers[j], layers[i]
+		}
+
+		ds.Images = append(ds.Images, debugImageChain{Root: root.Name, Layers: layers})
+	}
+
+	return ds
+}
+
+// matchesFilter implements the --filter key=value flag for one field of an
+// entry: an empty filterKey matches everything; otherwise it only matches
+// when field is the one being filtered on and value contains filterValue.
+func matchesFilter(filterKey, filterValue, field, value string) bool {
+	if filterKey == "" {
+		return true
+	}
+	if filterKey != field {
+		return false
+	}
+	return strings.Contains(value, filterValue)
+}
+
+func serveDebugState(w http.ResponseWriter, r *http.Request) {
+	filterKey, filterValue, _ := strings.Cut(r.URL.Query().Get("filter"), "=")
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(buildDebugState(filterKey, filterValue)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// runDebugDump fetches /debug/state from a running export process at addr
+// and writes it to w in the requested output format.
+func runDebugDump(w io.Writer, addr, output, filter string) error {
+	u := url.URL{Scheme: "http", Host: addr, Path: "/debug/state"}
+	if filter != "" {
+		q := u.Query()
+		q.Set("filter", filter)
+		u.RawQuery = q.Encode()
+	}
+
+	resp, err := http.Get(u.String())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status from %s: %s", u.String(), resp.Status)
+	}
+
+	var ds debugState
+	if err := json.NewDecoder(resp.Body).Decode(&ds); err != nil {
+		return err
+	}
+
+	switch output {
+	case "", "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(ds)
+	case "yaml":
+		return yaml.NewEncoder(w).Encode(ds)
+	default:
+		return fmt.Errorf("unknown output format %q, want json or yaml", output)
+	}
+}
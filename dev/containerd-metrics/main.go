@@ -6,6 +6,7 @@ package main
 
 import (
 	"context"
+	"net/http"
 	"os"
 	"os/signal"
 	"strings"
@@ -16,6 +17,8 @@ import (
 	apievents "github.com/containerd/containerd/api/events"
 	"github.com/containerd/containerd/events"
 	"github.com/containerd/typeurl"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	cli "github.com/urfave/cli/v2"
 
 	"github.com/gitpod-io/gitpod/common-go/log"
@@ -34,6 +37,21 @@ func main() {
 						Usage:     "path to the containerd socket",
 						Required:  true,
 					},
+					&cli.StringFlag{
+						Name:  "listen",
+						Usage: "address to serve the Prometheus /metrics endpoint on",
+						Value: ":9500",
+					},
+					&cli.IntFlag{
+						Name:  "max-entries",
+						Usage: "maximum number of entries kept per in-memory cache before evicting the least recently used one",
+						Value: 100_000,
+					},
+					&cli.DurationFlag{
+						Name:  "max-age",
+						Usage: "maximum age of a cache entry before it's evicted, regardless of max-entries. 0 disables age-based eviction",
+						Value: 6 * time.Hour,
+					},
 					&cli.BoolFlag{
 						Name:  "verbose",
 						Value: false,
@@ -41,7 +59,30 @@ func main() {
 				},
 				Action: func(c *cli.Context) error {
 					log.Init("containerd-metrics", "", true, c.Bool("verbose"))
-					return serveContainerdMetrics(c.String("socket"))
+					return serveContainerdMetrics(c.String("socket"), c.String("listen"), c.Int("max-entries"), c.Duration("max-age"))
+				},
+			},
+			{
+				Name:  "debug",
+				Usage: "Dumps a running export process's in-memory state for inspection",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "addr",
+						Usage: "address of a running 'export' process's --listen endpoint",
+						Value: "localhost:9500",
+					},
+					&cli.StringFlag{
+						Name:  "output",
+						Usage: "output format: json or yaml",
+						Value: "json",
+					},
+					&cli.StringFlag{
+						Name:  "filter",
+						Usage: "only dump entries matching key=value, e.g. name=sha256:...",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					return runDebugDump(os.Stdout, c.String("addr"), c.String("output"), c.String("filter"))
 				},
 			},
 		},
@@ -76,23 +117,116 @@ type Layer struct {
 }
 
 var (
-	prepByKey    = make(map[string]*Prep)
-	commitByKey  = make(map[string]*Commit)
-	commitByName = make(map[string]*Commit)
+	prepByKey    *boundedCache
+	commitByKey  *boundedCache
+	commitByName *boundedCache
+)
+
+var (
+	// instanceID is deliberately not a label here: it's a fresh UUID per
+	// workspace start, so on a long-lived node it would make these vectors
+	// grow by one permanent time series per workspace ever scheduled. It's
+	// still available in the "image pulled" log line below.
+	layerPrepDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "gitpod",
+		Subsystem: "containerd_metrics",
+		Name:      "layer_prep_duration_seconds",
+		Help:      "Time between SnapshotPrepare and the matching SnapshotCommit for a single layer",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"repository", "snapshot"})
+
+	imagePrepDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "gitpod",
+		Subsystem: "containerd_metrics",
+		Name:      "image_prep_duration_seconds",
+		Help:      "Sum of the per-layer SnapshotPrepare-to-SnapshotCommit durations of an image's layers, observed on ContainerCreate",
+		Buckets:   prometheus.ExponentialBuckets(0.5, 2, 12),
+	}, []string{"repository"})
+
+	snapshotRemoveTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "gitpod",
+		Subsystem: "containerd_metrics",
+		Name:      "snapshot_remove_total",
+		Help:      "Total number of SnapshotRemove events observed",
+	})
+
+	imageDeleteTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "gitpod",
+		Subsystem: "containerd_metrics",
+		Name:      "image_delete_total",
+		Help:      "Total number of ImageDelete events observed",
+	})
+
+	commitWithoutPrepTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "gitpod",
+		Subsystem: "containerd_metrics",
+		Name:      "commit_without_prep_total",
+		Help:      "Total number of SnapshotCommit events that arrived with no matching SnapshotPrepare, e.g. because it was evicted or the event was lost",
+	})
+
+	cacheEntries = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "gitpod",
+		Subsystem: "containerd_metrics",
+		Name:      "cache_entries",
+		Help:      "Current number of entries held in an in-memory cache",
+	}, []string{"cache"})
+
+	cacheEvictionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "gitpod",
+		Subsystem: "containerd_metrics",
+		Name:      "cache_evictions_total",
+		Help:      "Total number of entries evicted from an in-memory cache, either for exceeding max-entries or max-age",
+	}, []string{"cache"})
 )
 
-func serveContainerdMetrics(fn string) error {
+func init() {
+	prometheus.MustRegister(
+		layerPrepDuration, imagePrepDuration,
+		snapshotRemoveTotal, imageDeleteTotal, commitWithoutPrepTotal,
+		cacheEntries, cacheEvictionsTotal,
+	)
+}
+
+func serveContainerdMetrics(fn, listenAddr string, maxEntries int, maxAge time.Duration) error {
 	client, err := containerd.New(fn, containerd.WithDefaultNamespace("k8s.io"))
 	if err != nil {
 		return err
 	}
 
+	prepByKey, err = newBoundedCache(maxEntries, maxAge, cacheEntries.WithLabelValues("prepByKey"), cacheEvictionsTotal.WithLabelValues("prepByKey"))
+	if err != nil {
+		return err
+	}
+	commitByKey, err = newBoundedCache(maxEntries, maxAge, cacheEntries.WithLabelValues("commitByKey"), cacheEvictionsTotal.WithLabelValues("commitByKey"))
+	if err != nil {
+		return err
+	}
+	commitByName, err = newBoundedCache(maxEntries, maxAge, cacheEntries.WithLabelValues("commitByName"), cacheEvictionsTotal.WithLabelValues("commitByName"))
+	if err != nil {
+		return err
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 
+	go func() {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		mux.HandleFunc("/debug/state", serveDebugState)
+		log.WithField("addr", listenAddr).Info("serving metrics")
+		err := http.ListenAndServe(listenAddr, mux)
+		if err != nil {
+			log.WithError(err).Error("metrics server failed")
+		}
+	}()
+
+	if maxAge > 0 {
+		go pruneCachesPeriodically(ctx, maxAge/2)
+	}
+
 	evts, errs := client.EventService().Subscribe(ctx)
 	for {
 		var e *events.Envelope
@@ -112,29 +246,39 @@ func serveContainerdMetrics(fn string) error {
 
 		switch evt := evt.(type) {
 		case *apievents.SnapshotPrepare:
-			prepByKey[evt.Key] = &Prep{
+			p := &Prep{
 				T:      time.Now(),
 				Parent: evt.Parent,
 			}
-			log.WithField("obj", *prepByKey[evt.Key]).Debug("prep")
+			prepByKey.Add(evt.Key, p)
+			log.WithField("obj", *p).Debug("prep")
 		case *apievents.SnapshotCommit:
-			p, ok := prepByKey[evt.Key]
+			v, ok := prepByKey.Get(evt.Key)
 			if !ok {
+				commitWithoutPrepTotal.Inc()
 				log.WithField("key", evt.Key).WithField("name", evt.Name).Debug("found commit without prep")
 				continue
 			}
+			p := v.(*Prep)
 			c := &Commit{
 				Dur:    time.Since(p.T),
 				Name:   evt.Name,
 				Parent: p.Parent,
 				Key:    evt.Key,
 			}
-			commitByKey[evt.Key] = c
-			commitByName[evt.Name] = c
+			commitByKey.Add(evt.Key, c)
+			commitByName.Add(evt.Name, c)
 			log.WithField("obj", *c).Debug("commit")
 		case *apievents.SnapshotRemove:
+			snapshotRemoveTotal.Inc()
+			prepByKey.Remove(evt.Key)
+			commitByKey.Remove(evt.Key)
 			log.WithField("obj", evt).Info("snapshot remove")
 		case *apievents.ImageDelete:
+			imageDeleteTotal.Inc()
+			// ImageDelete only carries the image reference, not the snapshot
+			// keys/names that make up its layer chain, so there's nothing to
+			// evict here directly - those entries age out via max-age instead.
 			log.WithField("obj", evt).Info("image delete")
 		case *apievents.ContainerCreate:
 			pushContainerMetrics(evt.ID, evt.Image)
@@ -146,32 +290,68 @@ func pushContainerMetrics(id, image string) {
 	var img Image
 	img.Name = image
 
-	initialPrep, ok := prepByKey[id]
+	v, ok := prepByKey.Get(id)
 	if !ok {
 		log.WithField("image", image).WithField("id", id).Debug("image witout prep")
 		return
 	}
+	initialPrep := v.(*Prep)
 
 	var c *Commit
-	c, ok = commitByName[initialPrep.Parent]
+	v, ok = commitByName.Get(initialPrep.Parent)
 	for ok {
+		c = v.(*Commit)
 		img.Layer = append(img.Layer, Layer{
 			ID:   c.Name,
 			Prep: c.Dur,
 		})
 		img.TotalPrep += c.Dur
-		c, ok = commitByName[c.Parent]
+		v, ok = commitByName.Get(c.Parent)
 	}
 
 	for i, j := 0, len(img.Layer)-1; i < j; i, j = i+1, j-1 {
 		img.Layer[i], img.Layer[j] = img.Layer[j], img.Layer[i]
 	}
 
-	segs := strings.Split(img.Name, "/")
-	var instanceID string
-	if len(segs) == 3 {
-		instanceID = segs[2]
+	instanceID, repository := parseImageName(img.Name)
+
+	for _, l := range img.Layer {
+		layerPrepDuration.WithLabelValues(repository, l.ID).Observe(l.Prep.Seconds())
 	}
+	imagePrepDuration.WithLabelValues(repository).Observe(img.TotalPrep.Seconds())
 
 	log.WithField("instanceId", instanceID).WithField("image", img).WithField("id", id).WithField("initialPrep", initialPrep.Parent).Info("image pulled")
 }
+
+// pruneCachesPeriodically sweeps the caches for entries older than their
+// configured max-age on a fixed interval, until ctx is cancelled.
+func pruneCachesPeriodically(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = time.Minute
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			prepByKey.prune()
+			commitByKey.prune()
+			commitByName.prune()
+		}
+	}
+}
+
+// parseImageName splits a workspace image ref of the form
+// "<registry>/<repo>/<instanceID>" into its instanceID and repository parts.
+func parseImageName(name string) (instanceID, repository string) {
+	segs := strings.Split(name, "/")
+	if len(segs) != 3 {
+		return "", ""
+	}
+
+	return segs[2], strings.Join(segs[:2], "/")
+}